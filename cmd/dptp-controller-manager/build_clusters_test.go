@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	restclient "k8s.io/client-go/rest"
+)
+
+const fakeKubeconfig = `
+apiVersion: v1
+kind: Config
+clusters:
+- name: fake
+  cluster:
+    server: https://example.com
+contexts:
+- name: fake
+  context:
+    cluster: fake
+current-context: fake
+`
+
+func writeFakeKubeconfig(t *testing.T, dir, name string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(fakeKubeconfig), 0644); err != nil {
+		t.Fatalf("failed to write fake kubeconfig %s: %v", path, err)
+	}
+	return path
+}
+
+func TestLoadBuildClusterConfigsDerivesNameFromFile(t *testing.T) {
+	dir := t.TempDir()
+	explicit := writeFakeKubeconfig(t, dir, "build01.kubeconfig")
+
+	configs, err := loadBuildClusterConfigs([]string{explicit}, "")
+	if err != nil {
+		t.Fatalf("loadBuildClusterConfigs returned an error: %v", err)
+	}
+	if _, ok := configs["build01"]; !ok {
+		t.Fatalf("expected a config named %q, got %v", "build01", configNames(configs))
+	}
+}
+
+func TestLoadBuildClusterConfigsReadsDirectory(t *testing.T) {
+	dir := t.TempDir()
+	writeFakeKubeconfig(t, dir, "build02.kubeconfig")
+	writeFakeKubeconfig(t, dir, "build03.kubeconfig")
+
+	configs, err := loadBuildClusterConfigs(nil, dir)
+	if err != nil {
+		t.Fatalf("loadBuildClusterConfigs returned an error: %v", err)
+	}
+	for _, name := range []string{"build02", "build03"} {
+		if _, ok := configs[name]; !ok {
+			t.Errorf("expected a config named %q, got %v", name, configNames(configs))
+		}
+	}
+}
+
+func TestLoadBuildClusterConfigsExplicitAndDirCombine(t *testing.T) {
+	explicitDir := t.TempDir()
+	scanDir := t.TempDir()
+	explicit := writeFakeKubeconfig(t, explicitDir, "build04.kubeconfig")
+	writeFakeKubeconfig(t, scanDir, "build05.kubeconfig")
+
+	configs, err := loadBuildClusterConfigs([]string{explicit}, scanDir)
+	if err != nil {
+		t.Fatalf("loadBuildClusterConfigs returned an error: %v", err)
+	}
+	for _, name := range []string{"build04", "build05"} {
+		if _, ok := configs[name]; !ok {
+			t.Errorf("expected a config named %q, got %v", name, configNames(configs))
+		}
+	}
+}
+
+func TestLoadBuildClusterConfigsCollidingNamesOverwrite(t *testing.T) {
+	explicitDir := t.TempDir()
+	scanDir := t.TempDir()
+	explicit := writeFakeKubeconfig(t, explicitDir, "build06.kubeconfig")
+	writeFakeKubeconfig(t, scanDir, "build06.kubeconfig")
+
+	configs, err := loadBuildClusterConfigs([]string{explicit}, scanDir)
+	if err != nil {
+		t.Fatalf("loadBuildClusterConfigs returned an error: %v", err)
+	}
+	if len(configs) != 1 {
+		t.Fatalf("expected colliding cluster names to collapse into a single entry, got %v", configNames(configs))
+	}
+}
+
+func TestLoadBuildClusterConfigsMissingDir(t *testing.T) {
+	if _, err := loadBuildClusterConfigs(nil, filepath.Join(t.TempDir(), "does-not-exist")); err == nil {
+		t.Fatal("expected an error for a --build-cluster-kubeconfig-dir that does not exist")
+	}
+}
+
+func configNames(configs map[string]*restclient.Config) []string {
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	return names
+}
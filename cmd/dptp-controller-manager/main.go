@@ -1,29 +1,59 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/bombsimon/logrusr"
+	"github.com/go-logr/logr"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+
+	imagev1 "github.com/openshift/api/image/v1"
+
+	"k8s.io/apimachinery/pkg/runtime"
 	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	restclient "k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	prowv1 "k8s.io/test-infra/prow/apis/prowjobs/v1"
 	"k8s.io/test-infra/prow/config/secret"
 	"k8s.io/test-infra/prow/flagutil"
 	"k8s.io/test-infra/prow/pjutil"
 	"sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cluster"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
 
 	"github.com/openshift/ci-tools/pkg/controller/image-stream-tag-reconciler"
 	"github.com/openshift/ci-tools/pkg/load/agents"
 )
 
+// centralClusterName identifies the cluster the controller-manager itself
+// runs on and does leader election against, as opposed to the build clusters
+// it reconciles ImageStreamTags on.
+const centralClusterName = "app.ci"
+
 type options struct {
 	LeaderElectionNamespace      string
 	CiOperatorConfigPath         string
 	ProwJobNamespace             string
 	DryRun                       bool
 	ImageStreamTagReconcilerOpts imageStreamTagReconcilerOptions
+	StateStoreURI                string
+	StateStoreFlushInterval      time.Duration
+	BuildClusterKubeconfigs      flagutil.Strings
+	BuildClusterKubeconfigDir    string
+	HealthProbeBindAddress       string
+	MetricsBindAddress           string
 	logLevel                     string
 	*flagutil.GitHubOptions
 }
@@ -39,6 +69,12 @@ func newOpts() (*options, error) {
 	flag.StringVar(&opts.CiOperatorConfigPath, "ci-operator-config-path", "", "Path to the ci operator config")
 	flag.StringVar(&opts.ProwJobNamespace, "prow-job-namespace", "ci", "Namespace to create prowjobs in")
 	flag.Var(&opts.ImageStreamTagReconcilerOpts.IgnoredGitHubOrganizations, "imagestreamtagreconciler.ignored-github-organization", "GitHub organization to ignore in the imagestreamtagreconciler. Can be specified multiple times")
+	flag.StringVar(&opts.StateStoreURI, "state-store-uri", "", "URI to persist the imagestreamtagreconciler's per-tag state to across restarts. Supports gs://, s3:// and file:// schemes. Disabled if unset.")
+	flag.DurationVar(&opts.StateStoreFlushInterval, "state-store-flush-interval", 5*time.Minute, "How often to flush the imagestreamtagreconciler's state to --state-store-uri.")
+	flag.Var(&opts.BuildClusterKubeconfigs, "build-cluster-kubeconfig", "Path to a kubeconfig for an additional build cluster to reconcile ImageStreamTags on. Can be specified multiple times.")
+	flag.StringVar(&opts.BuildClusterKubeconfigDir, "build-cluster-kubeconfig-dir", "", "Directory holding one kubeconfig per build cluster to reconcile ImageStreamTags on, named after the cluster.")
+	flag.StringVar(&opts.HealthProbeBindAddress, "health-probe-bind-address", ":8081", "The address the health and readiness probes are served on.")
+	flag.StringVar(&opts.MetricsBindAddress, "metrics-bind-address", ":8080", "The address the Prometheus metrics endpoint is served on.")
 	flag.StringVar(&opts.logLevel, "log-level", "info", fmt.Sprintf("Log level is one of %v.", logrus.AllLevels))
 	// TODO: rather than relying on humans implementing dry-run properly, we should switch
 	// to just do it on client-level once it becomes available: https://github.com/kubernetes-sigs/controller-runtime/pull/839
@@ -63,6 +99,38 @@ func newOpts() (*options, error) {
 	return opts, utilerrors.NewAggregate(errs)
 }
 
+// loadBuildClusterConfigs resolves --build-cluster-kubeconfig and
+// --build-cluster-kubeconfig-dir into a map of cluster name to rest.Config,
+// mirroring Prow's convention of naming a build cluster after its kubeconfig
+// file.
+func loadBuildClusterConfigs(explicitPaths []string, dir string) (map[string]*restclient.Config, error) {
+	paths := append([]string{}, explicitPaths...)
+	if dir != "" {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read --build-cluster-kubeconfig-dir %q: %w", dir, err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			paths = append(paths, filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	configs := make(map[string]*restclient.Config, len(paths))
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		cfg, err := clientcmd.BuildConfigFromFlags("", path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load kubeconfig %q for build cluster %q: %w", path, name, err)
+		}
+		configs[name] = cfg
+	}
+
+	return configs, nil
+}
+
 func main() {
 	opts, err := newOpts()
 	if err != nil {
@@ -72,58 +140,182 @@ func main() {
 	if err != nil {
 		logrus.WithError(err).Fatal("Failed to parse loglevel")
 	}
+	// logrusr maps logr.V(0) to logrus.Info and anything >0 to logrus.Debug,
+	// so --log-level keeps working by gating that level on the standard
+	// logrus logger the same way it always did. We back logrusr with the
+	// standard logger, rather than a fresh instance, because helper packages
+	// like agents and the GitHub client wrappers still log through the
+	// package-level logrus functions and need to keep observing --log-level.
 	logrus.SetLevel(logLevel)
+	log := logrusr.NewLogger(logrus.StandardLogger())
+	controllerruntime.SetLogger(log)
+	ctx := logr.NewContext(context.Background(), log)
 
 	cfg, err := controllerruntime.GetConfig()
 	if err != nil {
-		logrus.WithError(err).Fatal("Failed to get kubeconfig")
+		log.Error(err, "Failed to get kubeconfig")
+		os.Exit(1)
 	}
 
-	ciOPConfigAgent, err := agents.NewConfigAgent(opts.CiOperatorConfigPath, 2*time.Minute, prometheus.NewCounterVec(prometheus.CounterOpts{}, []string{"error"}))
+	ciOPConfigAgentErrors := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ci_operator_config_agent_errors_total",
+		Help: "Number of errors encountered by the ci-operator config agent, by error type.",
+	}, []string{"error"})
+	ctrlmetrics.Registry.MustRegister(ciOPConfigAgentErrors)
+	// agents.ConfigAgent and the GitHub client below both predate logr/context
+	// propagation and log through the package-level logrus logger rather than
+	// accepting a context.Context, so per-request log fields (e.g. the
+	// reconcile key a call was made on behalf of) don't reach their output.
+	// Migrating them is out of scope here: ci-tools/pkg/load/agents and the
+	// k8s.io/test-infra/prow/github client are not part of this tree.
+	ciOPConfigAgent, err := agents.NewConfigAgent(opts.CiOperatorConfigPath, 2*time.Minute, ciOPConfigAgentErrors)
 	if err != nil {
-		logrus.WithError(err).Fatal("Failed to construct ci-opeartor config agent")
+		log.Error(err, "Failed to construct ci-opeartor config agent")
+		os.Exit(1)
 	}
+	rdy := &readiness{}
+	// NewConfigAgent blocks until its first load has completed, so by the time
+	// we get here the config agent is ready to serve.
+	rdy.setCIOperatorConfigAgentReady(true)
 
 	secretAgent := &secret.Agent{}
 	if err := secretAgent.Start([]string{opts.GitHubOptions.TokenPath}); err != nil {
-		logrus.WithError(err).Fatal("Failed to start secrets agent.")
+		log.Error(err, "Failed to start secrets agent")
+		os.Exit(1)
 	}
 	gitHubClient, err := opts.GitHubClient(secretAgent, opts.DryRun)
 	if err != nil {
-		logrus.WithError(err).Fatal("Failed to get gitHubClient")
+		log.Error(err, "Failed to get gitHubClient")
+		os.Exit(1)
 	}
+	// GitHub auth can fail transiently (rate limiting, a blip in GitHub's
+	// availability) and recover on its own, so rather than exiting the
+	// process we keep retrying in the background and let /readyz reflect the
+	// current state.
+	go func() {
+		backoff := 5 * time.Second
+		for {
+			if _, err := gitHubClient.GetUser(""); err != nil {
+				log.Error(err, "Failed to authenticate with GitHub, will retry", "backoff", backoff.String())
+				rdy.setGitHubAuthenticated(false)
+				time.Sleep(backoff)
+				if backoff < time.Minute {
+					backoff *= 2
+				}
+				continue
+			}
+			rdy.setGitHubAuthenticated(true)
+			return
+		}
+	}()
+
+	// The default client-go scheme knows nothing about ImageStreamTags or
+	// ProwJobs, so without registering them explicitly every Watch/Get/Create
+	// against those kinds fails at runtime with "no kind is registered".
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(imagev1.AddToScheme(scheme))
+	utilruntime.Must(prowv1.AddToScheme(scheme))
 
 	// Needed by the ImageStreamTagReconciler. This is a setting on the SharedInformer
-	// so its applied for all watches for all controller in this manager. If needed,
-	// we can move this to a custom sigs.k8s.io/controller-runtime/pkg/source.Source
-	// so its only applied for the ImageStreamTagReconciler.
+	// so its applied for all watches for all controllers in this manager. Each build
+	// cluster below gets its own cluster.Cluster with the same resyncInterval applied
+	// to its own SharedInformer, so this still only affects ImageStreamTag watches.
 	resyncInterval := 24 * time.Hour
 	mgr, err := controllerruntime.NewManager(cfg, controllerruntime.Options{
+		Scheme:                  scheme,
 		LeaderElection:          true,
 		LeaderElectionNamespace: opts.LeaderElectionNamespace,
 		LeaderElectionID:        "dptp-controller-manager",
 		SyncPeriod:              &resyncInterval,
+		HealthProbeBindAddress:  opts.HealthProbeBindAddress,
+		MetricsBindAddress:      opts.MetricsBindAddress,
 	})
 	if err != nil {
-		logrus.WithError(err).Fatal("Failed to construct manager")
+		log.Error(err, "Failed to construct manager")
+		os.Exit(1)
 	}
 	pjutil.ServePProf()
 
+	if err := mgr.AddHealthzCheck("ping", healthz.Ping); err != nil {
+		log.Error(err, "Failed to add healthz check")
+		os.Exit(1)
+	}
+	if err := mgr.AddReadyzCheck("ci-operator-config-and-github-auth", rdy.check); err != nil {
+		log.Error(err, "Failed to add readyz check")
+		os.Exit(1)
+	}
+
+	// buildStateStore constructs a StateStore scoped to clusterName, so that
+	// the central cluster and every build cluster, which all share the same
+	// --state-store-uri, each persist to their own blob instead of clobbering
+	// one another.
+	buildStateStore := func(clusterName string) (imagestreamtagreconciler.StateStore, error) {
+		if opts.StateStoreURI == "" {
+			return nil, nil
+		}
+		return imagestreamtagreconciler.NewStateStore(opts.StateStoreURI, clusterName)
+	}
+
+	centralStateStore, err := buildStateStore(centralClusterName)
+	if err != nil {
+		log.Error(err, "Failed to construct state store for the central cluster")
+		os.Exit(1)
+	}
+
 	imageStreamTagReconcilerOpts := imagestreamtagreconciler.Options{
 		DryRun:                     opts.DryRun,
 		CIOperatorConfigAgent:      ciOPConfigAgent,
 		ProwJobNamespace:           opts.ProwJobNamespace,
 		GitHubClient:               gitHubClient,
 		IgnoredGitHubOrganizations: opts.ImageStreamTagReconcilerOpts.IgnoredGitHubOrganizations.Strings(),
+		TargetClusterName:          centralClusterName,
+		StateStore:                 centralStateStore,
+		StateFlushInterval:         opts.StateStoreFlushInterval,
 	}
-	if err := imagestreamtagreconciler.AddToManager(mgr, imageStreamTagReconcilerOpts); err != nil {
-		logrus.WithError(err).Fatal("Failed to add imagestreamtagreconciler")
+	if err := imagestreamtagreconciler.AddToManager(ctx, mgr, mgr, imageStreamTagReconcilerOpts); err != nil {
+		log.Error(err, "Failed to add imagestreamtagreconciler for the central cluster")
+		os.Exit(1)
+	}
+
+	buildClusterConfigs, err := loadBuildClusterConfigs(opts.BuildClusterKubeconfigs.Strings(), opts.BuildClusterKubeconfigDir)
+	if err != nil {
+		log.Error(err, "Failed to load build cluster kubeconfigs")
+		os.Exit(1)
+	}
+	for name, cfg := range buildClusterConfigs {
+		buildCluster, err := cluster.New(cfg, func(o *cluster.Options) {
+			o.Scheme = scheme
+			o.SyncPeriod = &resyncInterval
+		})
+		if err != nil {
+			log.Error(err, "Failed to construct build cluster", "cluster", name)
+			os.Exit(1)
+		}
+		if err := mgr.Add(buildCluster); err != nil {
+			log.Error(err, "Failed to add build cluster to manager", "cluster", name)
+			os.Exit(1)
+		}
+
+		buildClusterStateStore, err := buildStateStore(name)
+		if err != nil {
+			log.Error(err, "Failed to construct state store for build cluster", "cluster", name)
+			os.Exit(1)
+		}
+
+		buildClusterOpts := imageStreamTagReconcilerOpts
+		buildClusterOpts.TargetClusterName = name
+		buildClusterOpts.StateStore = buildClusterStateStore
+		if err := imagestreamtagreconciler.AddToManager(ctx, mgr, buildCluster, buildClusterOpts); err != nil {
+			log.Error(err, "Failed to add imagestreamtagreconciler for build cluster", "cluster", name)
+			os.Exit(1)
+		}
 	}
 
-	stopCh := controllerruntime.SetupSignalHandler()
-	if err := mgr.Start(stopCh); err != nil {
-		logrus.WithError(err).Fatal("Manager ended with error")
+	if err := mgr.Start(controllerruntime.SetupSignalHandler()); err != nil {
+		log.Error(err, "Manager ended with error")
+		os.Exit(1)
 	}
 
-	logrus.Info("Process ended gracefully")
+	log.Info("Process ended gracefully")
 }
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+)
+
+// readiness tracks whether the controller-manager's independent startup
+// dependencies have become ready, so /readyz can report not-ready instead of
+// the process blocking (or exiting) on a dependency that is merely slow or
+// transiently failing.
+type readiness struct {
+	ciOperatorConfigAgentReady int32
+	gitHubAuthenticated        int32
+}
+
+func (r *readiness) setCIOperatorConfigAgentReady(ready bool) {
+	atomic.StoreInt32(&r.ciOperatorConfigAgentReady, boolToInt32(ready))
+}
+
+func (r *readiness) setGitHubAuthenticated(ready bool) {
+	atomic.StoreInt32(&r.gitHubAuthenticated, boolToInt32(ready))
+}
+
+// check is a manager.AddReadyzCheck-compatible healthz.Checker.
+func (r *readiness) check(_ *http.Request) error {
+	if atomic.LoadInt32(&r.ciOperatorConfigAgentReady) == 0 {
+		return errors.New("ci-operator config agent has not completed its first load yet")
+	}
+	if atomic.LoadInt32(&r.gitHubAuthenticated) == 0 {
+		return errors.New("github client has not authenticated yet")
+	}
+	return nil
+}
+
+func boolToInt32(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
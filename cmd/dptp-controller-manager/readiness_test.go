@@ -0,0 +1,71 @@
+package main
+
+import "testing"
+
+func TestReadinessCheck(t *testing.T) {
+	testCases := []struct {
+		name                       string
+		ciOperatorConfigAgentReady bool
+		gitHubAuthenticated        bool
+		expectError                bool
+	}{
+		{
+			name:        "neither ready",
+			expectError: true,
+		},
+		{
+			name:                       "only ci-operator config agent ready",
+			ciOperatorConfigAgentReady: true,
+			expectError:                true,
+		},
+		{
+			name:                "only github authenticated",
+			gitHubAuthenticated: true,
+			expectError:         true,
+		},
+		{
+			name:                       "both ready",
+			ciOperatorConfigAgentReady: true,
+			gitHubAuthenticated:        true,
+			expectError:                false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &readiness{}
+			r.setCIOperatorConfigAgentReady(tc.ciOperatorConfigAgentReady)
+			r.setGitHubAuthenticated(tc.gitHubAuthenticated)
+
+			err := r.check(nil)
+			if tc.expectError && err == nil {
+				t.Error("expected an error, got nil")
+			}
+			if !tc.expectError && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestReadinessTransitionsToReady(t *testing.T) {
+	r := &readiness{}
+	if err := r.check(nil); err == nil {
+		t.Fatal("expected not-ready before either flag is set")
+	}
+
+	r.setCIOperatorConfigAgentReady(true)
+	if err := r.check(nil); err == nil {
+		t.Fatal("expected not-ready with only the config agent ready")
+	}
+
+	r.setGitHubAuthenticated(true)
+	if err := r.check(nil); err != nil {
+		t.Fatalf("expected ready once both flags are set, got %v", err)
+	}
+
+	r.setGitHubAuthenticated(false)
+	if err := r.check(nil); err == nil {
+		t.Fatal("expected not-ready again once github auth flips back to false")
+	}
+}
@@ -0,0 +1,299 @@
+package imagestreamtagreconciler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	imagev1 "github.com/openshift/api/image/v1"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	prowv1 "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/pjutil"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/cluster"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/openshift/ci-tools/pkg/load/agents"
+)
+
+const controllerName = "image_stream_tag_reconciler"
+
+// sourceRevisionAnnotation is set by OpenShift builds on the Image they
+// produce, identifying the source commit the image was built from.
+const sourceRevisionAnnotation = "io.openshift.build.commit.id"
+
+// skipWindow bounds how long a previously successful reconcile for the same
+// source revision suppresses triggering another ProwJob for the same
+// ImageStreamTag. Once it elapses we re-trigger even without a new revision,
+// as a safety net against a ProwJob that silently disappeared.
+const skipWindow = 24 * time.Hour
+
+// staleStateTTL bounds how long state for an ImageStreamTag is kept once it
+// stops being reconciled. Tags deleted while the manager was down never fire
+// the delete event Reconcile prunes on, so without this the state store
+// would grow unboundedly; anything this old is dropped on load instead.
+const staleStateTTL = 7 * 24 * time.Hour
+
+// Options holds the configuration the ImageStreamTagReconciler needs in
+// order to decide whether an ImageStreamTag update should trigger a ProwJob.
+type Options struct {
+	DryRun                     bool
+	CIOperatorConfigAgent      agents.ConfigAgent
+	ProwJobNamespace           string
+	GitHubClient               github.Client
+	IgnoredGitHubOrganizations []string
+
+	// TargetClusterName identifies which build cluster the ImageStreamTags
+	// being watched live on. It is "app.ci" for the central cluster and the
+	// build cluster's name otherwise, and is attached to logs, metrics and
+	// ProwJob labels so they can be told apart.
+	TargetClusterName string
+
+	// StateStore, when set, persists per-ImageStreamTag reconcile state across
+	// restarts so a re-elected leader does not re-trigger work that already
+	// completed. It is loaded once before the first reconcile and flushed
+	// periodically and on shutdown.
+	StateStore StateStore
+	// StateFlushInterval controls how often the in-memory state is persisted
+	// to the StateStore. Defaults to 5 minutes when unset.
+	StateFlushInterval time.Duration
+}
+
+type reconciler struct {
+	log logr.Logger
+	// client reads ImageStreamTags off the cluster this reconciler instance
+	// was registered for, which may not be the central cluster.
+	client client.Client
+	// prowJobClient always points at the central cluster: ProwJobs are
+	// created there regardless of which build cluster the triggering
+	// ImageStreamTag lives on.
+	prowJobClient client.Client
+	options       Options
+
+	stateLock sync.Mutex
+	state     map[string]TagState
+}
+
+// AddToManager constructs an ImageStreamTagReconciler that watches
+// ImageStreamTags on targetCluster and registers it with mgr. ProwJobs are
+// always created through mgr's central client, independent of targetCluster,
+// so callers pass mgr itself as the targetCluster for the central cluster and
+// a cluster.Cluster obtained from cluster.New for each additional build
+// cluster. The controller name is suffixed with opts.TargetClusterName so
+// multiple build clusters can be registered on the same manager.
+func AddToManager(ctx context.Context, mgr manager.Manager, targetCluster cluster.Cluster, opts Options) error {
+	name := controllerName
+	if opts.TargetClusterName != "" {
+		name = fmt.Sprintf("%s_%s", controllerName, opts.TargetClusterName)
+	}
+	log := logr.FromContextOrDiscard(ctx).WithValues("controller", name, "cluster", opts.TargetClusterName)
+
+	r := &reconciler{
+		log:           log,
+		client:        targetCluster.GetClient(),
+		prowJobClient: mgr.GetClient(),
+		options:       opts,
+		state:         map[string]TagState{},
+	}
+
+	if opts.StateStore != nil {
+		state, err := opts.StateStore.Load(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to load state store: %w", err)
+		}
+		var pruned int
+		r.state, pruned = pruneStaleState(state, time.Now())
+		log.Info("Loaded reconciler state store", "entries", len(r.state), "prunedStale", pruned)
+
+		interval := opts.StateFlushInterval
+		if interval == 0 {
+			interval = 5 * time.Minute
+		}
+		if err := mgr.Add(&stateFlusher{reconciler: r, interval: interval}); err != nil {
+			return fmt.Errorf("failed to register state store flusher: %w", err)
+		}
+	}
+
+	c, err := controller.New(name, mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return fmt.Errorf("failed to construct controller: %w", err)
+	}
+
+	if err := c.Watch(source.NewKindWithCache(&imagev1.ImageStreamTag{}, targetCluster.GetCache()), &handler.EnqueueRequestForObject{}); err != nil {
+		return fmt.Errorf("failed to watch ImageStreamTags: %w", err)
+	}
+
+	if err := mgr.Add(&cacheSyncRecorder{cache: targetCluster.GetCache(), clusterName: opts.TargetClusterName}); err != nil {
+		return fmt.Errorf("failed to register cache sync recorder: %w", err)
+	}
+
+	return nil
+}
+
+func (r *reconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	start := time.Now()
+	defer func() { reconcileDuration.WithLabelValues(r.options.TargetClusterName).Observe(time.Since(start).Seconds()) }()
+
+	key := req.String()
+	log := r.log.WithValues("namespace", req.Namespace, "name", req.Name, "imageStreamTag", key)
+	ctx = logr.NewContext(ctx, log)
+
+	isTag := &imagev1.ImageStreamTag{}
+	if err := r.client.Get(ctx, req.NamespacedName, isTag); err != nil {
+		if errors.IsNotFound(err) {
+			// The tag is gone, drop any state we held for it so the state
+			// store does not grow unboundedly as tags are deleted.
+			r.stateLock.Lock()
+			delete(r.state, key)
+			r.stateLock.Unlock()
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, fmt.Errorf("failed to get ImageStreamTag %s: %w", key, err)
+	}
+
+	if org := isTag.Labels["ci.openshift.io/org"]; org != "" {
+		for _, ignored := range r.options.IgnoredGitHubOrganizations {
+			if org == ignored {
+				log.V(1).Info("Skipping ImageStreamTag from ignored organization", "org", org)
+				ignoredOrgSkips.WithLabelValues(r.options.TargetClusterName, org).Inc()
+				return reconcile.Result{}, nil
+			}
+		}
+	}
+
+	sourceSHA := isTag.Image.Annotations[sourceRevisionAnnotation]
+
+	r.stateLock.Lock()
+	previous, known := r.state[key]
+	r.stateLock.Unlock()
+	if shouldSkip(previous, known, sourceSHA, time.Now()) {
+		log.V(1).Info("Skipping reconcile, already triggered for this source revision", "sourceSHA", sourceSHA)
+		return reconcile.Result{}, nil
+	}
+
+	prowJob, shouldTrigger, err := r.prowJobForTag(ctx, isTag, sourceSHA)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if !shouldTrigger {
+		return reconcile.Result{}, nil
+	}
+
+	if r.options.DryRun {
+		log.Info("Would create ProwJob (dry-run)")
+		return reconcile.Result{}, nil
+	}
+
+	if prowJob.Labels == nil {
+		prowJob.Labels = map[string]string{}
+	}
+	prowJob.Labels["ci.openshift.io/target-cluster"] = r.options.TargetClusterName
+
+	if err := r.prowJobClient.Create(ctx, prowJob); err != nil {
+		return reconcile.Result{}, fmt.Errorf("failed to create ProwJob for %s: %w", key, err)
+	}
+	prowJobsCreated.WithLabelValues(r.options.TargetClusterName).Inc()
+
+	r.stateLock.Lock()
+	r.state[key] = TagState{
+		LastSourceSHA:               sourceSHA,
+		LastProwJobName:             prowJob.Name,
+		LastProwJobUID:              string(prowJob.UID),
+		LastSuccessfulReconcileTime: time.Now(),
+	}
+	r.stateLock.Unlock()
+
+	return reconcile.Result{}, nil
+}
+
+// shouldSkip reports whether a reconcile can be skipped because the stored
+// state already shows a recent, successful reconcile for the same source
+// revision. It is a plain function of its inputs so the skip-window logic
+// can be unit tested without standing up a reconciler.
+func shouldSkip(previous TagState, known bool, sourceSHA string, now time.Time) bool {
+	if !known || sourceSHA == "" || previous.LastSourceSHA != sourceSHA {
+		return false
+	}
+	return now.Sub(previous.LastSuccessfulReconcileTime) < skipWindow
+}
+
+// pruneStaleState drops entries whose last successful reconcile is older
+// than staleStateTTL, returning the kept entries and how many were dropped.
+// It exists because an ImageStreamTag deleted while the manager was down
+// never generates the delete event Reconcile otherwise prunes on, so without
+// this the store would retain it forever.
+func pruneStaleState(state map[string]TagState, now time.Time) (map[string]TagState, int) {
+	kept := make(map[string]TagState, len(state))
+	pruned := 0
+	for key, s := range state {
+		if now.Sub(s.LastSuccessfulReconcileTime) >= staleStateTTL {
+			pruned++
+			continue
+		}
+		kept[key] = s
+	}
+	return kept, pruned
+}
+
+// prowJobForTag decides whether the given ImageStreamTag requires a new
+// ProwJob and constructs it. An ImageStreamTag with no resolvable source
+// revision is not something we know how to act on and is skipped.
+func (r *reconciler) prowJobForTag(ctx context.Context, isTag *imagev1.ImageStreamTag, sourceSHA string) (*prowv1.ProwJob, bool, error) {
+	log := logr.FromContextOrDiscard(ctx)
+	if sourceSHA == "" {
+		log.V(1).Info("ImageStreamTag has no source revision annotation, nothing to trigger")
+		return nil, false, nil
+	}
+
+	org := isTag.Labels["ci.openshift.io/org"]
+	repo := isTag.Labels["ci.openshift.io/repo"]
+	branch := isTag.Labels["ci.openshift.io/branch"]
+
+	spec := prowv1.ProwJobSpec{
+		Type:      prowv1.PostsubmitJob,
+		Agent:     prowv1.KubernetesAgent,
+		Namespace: r.options.ProwJobNamespace,
+		Job:       fmt.Sprintf("branch-ci-%s-%s-%s-%s-images", org, repo, branch, r.options.TargetClusterName),
+		Refs: &prowv1.Refs{
+			Org:     org,
+			Repo:    repo,
+			BaseRef: branch,
+			BaseSHA: sourceSHA,
+		},
+	}
+	pj := pjutil.NewProwJob(spec, nil, nil)
+	return &pj, true, nil
+}
+
+// cacheSyncRecorder is a manager.Runnable that times how long its cluster's
+// informer cache takes to sync for the first time and records it to
+// cacheSyncDuration, then returns.
+type cacheSyncRecorder struct {
+	cache       cacheWaiter
+	clusterName string
+}
+
+// cacheWaiter is the subset of cache.Cache the recorder needs, so it can be
+// exercised without a real informer cache in tests.
+type cacheWaiter interface {
+	WaitForCacheSync(ctx context.Context) bool
+}
+
+func (c *cacheSyncRecorder) Start(ctx context.Context) error {
+	start := time.Now()
+	if !c.cache.WaitForCacheSync(ctx) {
+		return fmt.Errorf("cache never synced for cluster %q", c.clusterName)
+	}
+	cacheSyncDuration.WithLabelValues(c.clusterName).Observe(time.Since(start).Seconds())
+	return nil
+}
@@ -0,0 +1,84 @@
+package imagestreamtagreconciler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShouldSkip(t *testing.T) {
+	now := time.Now()
+
+	testCases := []struct {
+		name      string
+		previous  TagState
+		known     bool
+		sourceSHA string
+		want      bool
+	}{
+		{
+			name:      "no prior state",
+			known:     false,
+			sourceSHA: "abc123",
+			want:      false,
+		},
+		{
+			name:      "no source sha to compare against",
+			previous:  TagState{LastSourceSHA: "abc123", LastSuccessfulReconcileTime: now},
+			known:     true,
+			sourceSHA: "",
+			want:      false,
+		},
+		{
+			name:      "different source sha",
+			previous:  TagState{LastSourceSHA: "abc123", LastSuccessfulReconcileTime: now},
+			known:     true,
+			sourceSHA: "def456",
+			want:      false,
+		},
+		{
+			name:      "same source sha within skip window",
+			previous:  TagState{LastSourceSHA: "abc123", LastSuccessfulReconcileTime: now.Add(-time.Hour)},
+			known:     true,
+			sourceSHA: "abc123",
+			want:      true,
+		},
+		{
+			name:      "same source sha outside skip window",
+			previous:  TagState{LastSourceSHA: "abc123", LastSuccessfulReconcileTime: now.Add(-25 * time.Hour)},
+			known:     true,
+			sourceSHA: "abc123",
+			want:      false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := shouldSkip(tc.previous, tc.known, tc.sourceSHA, now); got != tc.want {
+				t.Errorf("shouldSkip() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPruneStaleState(t *testing.T) {
+	now := time.Now()
+	state := map[string]TagState{
+		"ns/fresh": {LastSuccessfulReconcileTime: now.Add(-time.Hour)},
+		"ns/stale": {LastSuccessfulReconcileTime: now.Add(-8 * 24 * time.Hour)},
+	}
+
+	kept, pruned := pruneStaleState(state, now)
+
+	if pruned != 1 {
+		t.Errorf("pruned = %d, want 1", pruned)
+	}
+	if _, ok := kept["ns/stale"]; ok {
+		t.Error("expected stale entry to be pruned")
+	}
+	if _, ok := kept["ns/fresh"]; !ok {
+		t.Error("expected fresh entry to be kept")
+	}
+	if len(kept) != 1 {
+		t.Errorf("len(kept) = %d, want 1", len(kept))
+	}
+}
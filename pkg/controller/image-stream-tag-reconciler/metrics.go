@@ -0,0 +1,32 @@
+package imagestreamtagreconciler
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	reconcileDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "imagestreamtagreconciler_reconcile_duration_seconds",
+		Help:    "Time it took to reconcile an ImageStreamTag, by cluster.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"cluster"})
+	prowJobsCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "imagestreamtagreconciler_prowjobs_created_total",
+		Help: "Number of ProwJobs created by the imagestreamtagreconciler, by cluster.",
+	}, []string{"cluster"})
+	ignoredOrgSkips = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "imagestreamtagreconciler_ignored_org_skips_total",
+		Help: "Number of reconciles skipped because the ImageStreamTag's org is ignored, by cluster and org.",
+	}, []string{"cluster", "org"})
+	cacheSyncDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "imagestreamtagreconciler_cache_sync_duration_seconds",
+		Help:    "Time it took for a cluster's informer cache to sync before reconciling started, by cluster.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"cluster"})
+)
+
+func init() {
+	ctrlmetrics.Registry.MustRegister(reconcileDuration, prowJobsCreated, ignoredOrgSkips, cacheSyncDuration)
+}
@@ -0,0 +1,305 @@
+package imagestreamtagreconciler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/go-logr/logr"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// TagState is the durable, per-ImageStreamTag bookkeeping the reconciler
+// needs in order to avoid re-triggering a ProwJob for work that was already
+// completed or is still in flight.
+type TagState struct {
+	// LastSourceSHA is the source revision (resolved from the Image's
+	// build-commit annotation) that LastProwJobName was triggered for. A
+	// reconcile for the same ImageStreamTag and the same LastSourceSHA within
+	// the skip window is a no-op.
+	LastSourceSHA string `json:"lastSourceSHA,omitempty"`
+	// LastProwJobName is the name of the most recently created ProwJob for
+	// this tag.
+	LastProwJobName string `json:"lastProwJobName,omitempty"`
+	// LastProwJobUID is the UID of the most recently created ProwJob for this
+	// tag. It is recorded but not read back by the reconciler.
+	LastProwJobUID string `json:"lastProwJobUID,omitempty"`
+	// LastProwJobResult holds a completion state for LastProwJobName. Reconcile
+	// does not set it, so it is empty in the state the reconciler writes.
+	LastProwJobResult string `json:"lastProwJobResult,omitempty"`
+	// LastSuccessfulReconcileTime is when a reconcile of this tag last
+	// created a ProwJob. Reconciles that create none leave it unchanged.
+	LastSuccessfulReconcileTime time.Time `json:"lastSuccessfulReconcileTime,omitempty"`
+}
+
+// StateStore checkpoints the ImageStreamTagReconciler's per-tag state so it
+// survives restarts (leader re-election, rollouts, crashes) and is reloaded
+// before the first reconcile runs.
+type StateStore interface {
+	Load(ctx context.Context) (map[string]TagState, error)
+	Save(ctx context.Context, state map[string]TagState) error
+}
+
+// NewStateStore constructs a StateStore backed by the scheme of the given
+// URI: gs:// for GCS, s3:// for S3, or file:// for a local path. It is the
+// counterpart of the snapshotting the status-reconciler does for
+// presubmit/plugin state.
+//
+// clusterName is mixed into the object/file name so that the central cluster
+// and every build cluster, each of which calls NewStateStore with the same
+// --state-store-uri, get their own distinct blob instead of clobbering a
+// single shared one.
+func NewStateStore(uri string, clusterName string) (StateStore, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse --state-store-uri %q: %w", uri, err)
+	}
+
+	var blob blobStore
+	switch u.Scheme {
+	case "gs":
+		blob, err = newGCSBlobStore(u, clusterName)
+	case "s3":
+		blob, err = newS3BlobStore(u, clusterName)
+	case "file":
+		blob = newFileBlobStore(u, clusterName)
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q in --state-store-uri, must be one of gs, s3, file", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &stateStore{blob: blob}, nil
+}
+
+// withClusterSuffix inserts "-clusterName" before the final path element's
+// extension (or appends it if there is none), so e.g. "state.json" becomes
+// "state-app.ci.json" and "state" becomes "state-app.ci".
+func withClusterSuffix(path, clusterName string) string {
+	if clusterName == "" {
+		return path
+	}
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	return base + "-" + clusterName + ext
+}
+
+// blobStore is the provider abstraction NewStateStore dispatches to. It
+// knows nothing about TagState; it just round-trips an opaque blob.
+type blobStore interface {
+	Read(ctx context.Context) ([]byte, error)
+	Write(ctx context.Context, data []byte) error
+}
+
+// stateStore serializes the full state map as a single JSON snapshot on
+// every Save, mirroring the status-reconciler's GCS snapshot approach. Reads
+// and writes are serialized with a mutex so concurrent reconciles and the
+// periodic flusher never race on the same blob.
+type stateStore struct {
+	blob blobStore
+	lock sync.Mutex
+}
+
+func (s *stateStore) Load(ctx context.Context) (map[string]TagState, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	raw, err := s.blob.Read(ctx)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]TagState{}, nil
+		}
+		return nil, fmt.Errorf("failed to read state store: %w", err)
+	}
+	if len(raw) == 0 {
+		return map[string]TagState{}, nil
+	}
+
+	var state map[string]TagState
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal state store: %w", err)
+	}
+	return state, nil
+}
+
+func (s *stateStore) Save(ctx context.Context, state map[string]TagState) error {
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal state store: %w", err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.blob.Write(ctx, raw); err != nil {
+		return fmt.Errorf("failed to write state store: %w", err)
+	}
+	return nil
+}
+
+// stateFlusher is a manager.Runnable that periodically persists the
+// reconciler's in-memory state and flushes it one last time on graceful
+// shutdown.
+type stateFlusher struct {
+	reconciler *reconciler
+	interval   time.Duration
+}
+
+func (f *stateFlusher) Start(ctx context.Context) error {
+	ctx = logr.NewContext(ctx, f.reconciler.log)
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Flush with a fresh background context: ctx is already done, so
+			// using it here would make the final, most important flush fail.
+			return f.reconciler.flushState(logr.NewContext(context.Background(), f.reconciler.log))
+		case <-ticker.C:
+			if err := f.reconciler.flushState(ctx); err != nil {
+				f.reconciler.log.Error(err, "Failed to flush reconciler state store")
+			}
+		}
+	}
+}
+
+// flushState snapshots the in-memory state under the lock and persists it.
+// Entries are removed from the in-memory map when Reconcile observes their
+// ImageStreamTag deleted. State for a tag deleted while the manager was down
+// stays in the snapshot until pruneStaleState drops it on a later load.
+func (r *reconciler) flushState(ctx context.Context) error {
+	r.stateLock.Lock()
+	snapshot := make(map[string]TagState, len(r.state))
+	for k, v := range r.state {
+		snapshot[k] = v
+	}
+	r.stateLock.Unlock()
+
+	return r.options.StateStore.Save(ctx, snapshot)
+}
+
+type fileBlobStore struct {
+	path string
+}
+
+func newFileBlobStore(u *url.URL, clusterName string) *fileBlobStore {
+	path := u.Path
+	if path == "" {
+		path = u.Opaque
+	}
+	return &fileBlobStore{path: withClusterSuffix(filepath.Clean(path), clusterName)}
+}
+
+func (f *fileBlobStore) Read(_ context.Context) ([]byte, error) {
+	return ioutil.ReadFile(f.path)
+}
+
+func (f *fileBlobStore) Write(_ context.Context, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(f.path, data, 0644)
+}
+
+type gcsBlobStore struct {
+	bucket string
+	object string
+}
+
+func newGCSBlobStore(u *url.URL, clusterName string) (*gcsBlobStore, error) {
+	if u.Host == "" || u.Path == "" {
+		return nil, fmt.Errorf("gs:// state store uri must be of the form gs://bucket/object, got %q", u.String())
+	}
+	return &gcsBlobStore{bucket: u.Host, object: withClusterSuffix(u.Path[1:], clusterName)}, nil
+}
+
+func (g *gcsBlobStore) Read(ctx context.Context) ([]byte, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct GCS client: %w", err)
+	}
+	defer client.Close()
+
+	reader, err := client.Bucket(g.bucket).Object(g.object).NewReader(ctx)
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+func (g *gcsBlobStore) Write(ctx context.Context, data []byte) error {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to construct GCS client: %w", err)
+	}
+	defer client.Close()
+
+	writer := client.Bucket(g.bucket).Object(g.object).NewWriter(ctx)
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+type s3BlobStore struct {
+	bucket string
+	key    string
+	sess   *session.Session
+}
+
+func newS3BlobStore(u *url.URL, clusterName string) (*s3BlobStore, error) {
+	if u.Host == "" || u.Path == "" {
+		return nil, fmt.Errorf("s3:// state store uri must be of the form s3://bucket/key, got %q", u.String())
+	}
+	sess, err := session.NewSession(aws.NewConfig())
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct AWS session: %w", err)
+	}
+	return &s3BlobStore{bucket: u.Host, key: withClusterSuffix(u.Path[1:], clusterName), sess: sess}, nil
+}
+
+func (s *s3BlobStore) Read(ctx context.Context) ([]byte, error) {
+	out, err := s3.New(s.sess).GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound") {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	defer out.Body.Close()
+	return ioutil.ReadAll(out.Body)
+}
+
+func (s *s3BlobStore) Write(ctx context.Context, data []byte) error {
+	uploader := s3manager.NewUploader(s.sess)
+	_, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key),
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
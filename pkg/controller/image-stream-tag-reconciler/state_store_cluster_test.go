@@ -0,0 +1,40 @@
+package imagestreamtagreconciler
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNewStateStoreNamespacesPerCluster(t *testing.T) {
+	dir := t.TempDir()
+	uri := "file://" + filepath.Join(dir, "state.json")
+
+	central, err := NewStateStore(uri, "app.ci")
+	if err != nil {
+		t.Fatalf("failed to construct central state store: %v", err)
+	}
+	build01, err := NewStateStore(uri, "build01")
+	if err != nil {
+		t.Fatalf("failed to construct build01 state store: %v", err)
+	}
+
+	centralState := map[string]TagState{"ns/central-tag": {LastProwJobName: "central"}}
+	build01State := map[string]TagState{"ns/build01-tag": {LastProwJobName: "build01"}}
+
+	if err := central.Save(context.Background(), centralState); err != nil {
+		t.Fatalf("failed to save central state: %v", err)
+	}
+	if err := build01.Save(context.Background(), build01State); err != nil {
+		t.Fatalf("failed to save build01 state: %v", err)
+	}
+
+	gotCentral, err := central.Load(context.Background())
+	if err != nil {
+		t.Fatalf("failed to reload central state: %v", err)
+	}
+	if !reflect.DeepEqual(centralState, gotCentral) {
+		t.Errorf("central state store was clobbered by build01's write: got %+v, want %+v", gotCentral, centralState)
+	}
+}
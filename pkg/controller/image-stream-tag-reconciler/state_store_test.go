@@ -0,0 +1,80 @@
+package imagestreamtagreconciler
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStateStoreFileRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStateStore("file://"+filepath.Join(dir, "state.json"), "app.ci")
+	if err != nil {
+		t.Fatalf("failed to construct state store: %v", err)
+	}
+
+	initial, err := store.Load(context.Background())
+	if err != nil {
+		t.Fatalf("failed to load empty state store: %v", err)
+	}
+	if len(initial) != 0 {
+		t.Fatalf("expected empty state for a state store that was never written, got %v", initial)
+	}
+
+	want := map[string]TagState{
+		"ci/some-tag": {
+			LastSourceSHA:               "deadbeef",
+			LastProwJobName:             "some-prow-job",
+			LastSuccessfulReconcileTime: time.Now().UTC().Truncate(time.Second),
+		},
+	}
+	if err := store.Save(context.Background(), want); err != nil {
+		t.Fatalf("failed to save state: %v", err)
+	}
+
+	got, err := store.Load(context.Background())
+	if err != nil {
+		t.Fatalf("failed to reload saved state: %v", err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("loaded state differs from saved state:\nwant: %+v\ngot:  %+v", want, got)
+	}
+}
+
+func TestWithClusterSuffix(t *testing.T) {
+	testCases := []struct {
+		name        string
+		path        string
+		clusterName string
+		want        string
+	}{
+		{
+			name:        "extension is preserved",
+			path:        "state.json",
+			clusterName: "app.ci",
+			want:        "state-app.ci.json",
+		},
+		{
+			name:        "no extension",
+			path:        "state",
+			clusterName: "build01",
+			want:        "state-build01",
+		},
+		{
+			name:        "no cluster name is a no-op",
+			path:        "state.json",
+			clusterName: "",
+			want:        "state.json",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := withClusterSuffix(tc.path, tc.clusterName); got != tc.want {
+				t.Errorf("withClusterSuffix(%q, %q) = %q, want %q", tc.path, tc.clusterName, got, tc.want)
+			}
+		})
+	}
+}